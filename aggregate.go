@@ -0,0 +1,76 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// aggregate turns a group of same-key samples into the InterMetrics a
+// sink should receive. Percentile-bearing types (histograms, timers)
+// produce one InterMetric per configured percentile, named
+// "<name>.<p*100>percentile"; when includeAggregates is set they also
+// produce "<name>.min", "<name>.max" and "<name>.count" for whichever
+// of those appear in config.Aggregates. Other types (counters, gauges,
+// sets) are flushed as a single InterMetric carrying the most recent
+// sample's value.
+func aggregate(
+	config Config, key samplers.MetricKey, samples []samplers.UDPMetric, includeAggregates bool,
+) []samplers.InterMetric {
+	if key.Type != HistogramTypeName && key.Type != TimerTypeName {
+		last := samples[len(samples)-1]
+		return []samplers.InterMetric{{Name: key.Name, Value: last.Value}}
+	}
+
+	values := make([]float64, 0, len(samples))
+	for _, s := range samples {
+		if f, ok := s.Value.(float64); ok {
+			values = append(values, f)
+		}
+	}
+	sort.Float64s(values)
+
+	out := make([]samplers.InterMetric, 0, len(config.Percentiles)+len(config.Aggregates))
+	for _, p := range config.Percentiles {
+		out = append(out, samplers.InterMetric{
+			Name:  fmt.Sprintf("%s.%dpercentile", key.Name, int(p*100)),
+			Value: percentile(values, p),
+		})
+	}
+
+	if includeAggregates {
+		for _, agg := range config.Aggregates {
+			switch agg {
+			case "min":
+				out = append(out, samplers.InterMetric{Name: key.Name + ".min", Value: values[0]})
+			case "max":
+				out = append(out, samplers.InterMetric{Name: key.Name + ".max", Value: values[len(values)-1]})
+			case "count":
+				out = append(out, samplers.InterMetric{Name: key.Name + ".count", Value: float64(len(values))})
+			}
+		}
+	}
+	return out
+}
+
+// percentile returns the value at the p-th percentile (0 < p < 1) of
+// a sorted slice of values: the element at index floor(p*len(sorted)),
+// clamped to the last element. It does not interpolate between
+// neighbouring values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// isForwardableType reports whether key.Type is a percentile-bearing
+// type that needs samples merged across hosts at the global tier.
+func isForwardableType(key samplers.MetricKey) bool {
+	return key.Type == HistogramTypeName || key.Type == TimerTypeName
+}
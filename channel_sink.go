@@ -0,0 +1,35 @@
+package veneur
+
+import (
+	"context"
+
+	"github.com/stripe/veneur/v14/samplers"
+	"github.com/stripe/veneur/v14/sinks"
+)
+
+// channelMetricSink is a MetricSink that republishes each flushed
+// batch on a channel, for tests to observe what a Server flushed
+// without standing up a real downstream metrics backend.
+type channelMetricSink struct {
+	ch chan []samplers.InterMetric
+}
+
+// NewChannelMetricSink creates a MetricSink that writes every flushed
+// batch to ch. Flush blocks until the batch is received, so a test
+// reading from ch controls the pace of the Server's flush.
+func NewChannelMetricSink(ch chan []samplers.InterMetric) (sinks.MetricSink, error) {
+	return &channelMetricSink{ch: ch}, nil
+}
+
+func (s *channelMetricSink) Name() string {
+	return "channel"
+}
+
+func (s *channelMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	select {
+	case s.ch <- metrics:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package veneur
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/stripe/veneur/v14/sinks"
+	"github.com/stripe/veneur/v14/util"
+)
+
+// Config holds the configuration for a local veneur.Server.
+type Config struct {
+	Debug bool
+
+	Interval    time.Duration
+	Percentiles []float64
+	Aggregates  []string
+
+	ReadBufferSizeBytes int
+	HTTPAddress         string
+	GrpcAddress         string
+	NumWorkers          int
+	NumReaders          int
+	StatsAddress        string
+	SsfListenAddresses  []util.Url
+	TraceMaxLengthBytes int
+
+	// ForwardAddress is where this Server forwards GlobalOnly and
+	// mixed-scope percentile metrics to: the address of a Proxy, or a
+	// global Server directly. It may hold a comma-separated list of
+	// such addresses, which the Server's ForwardClient fails over
+	// between.
+	ForwardAddress string
+	// ForwardUseGrpc is not read by Server: a Server with a
+	// ForwardAddress always forwards over gRPC, and no HTTP forwarding
+	// protocol is implemented.
+	ForwardUseGrpc bool
+
+	// ForwardDialTimeout and ForwardRequestTimeout mirror
+	// grpcpool.Config's fields of the same name for the connection
+	// pool backing gRPC forwarding.
+	ForwardDialTimeout    time.Duration
+	ForwardRequestTimeout time.Duration
+
+	MetricSinks []SinkConfig
+}
+
+// MetricSinkConfig is the sink-specific configuration blob passed to
+// a MetricSinkTypeEntry's Create and ParseConfig functions. Its
+// concrete type is defined by the sink implementation.
+type MetricSinkConfig interface{}
+
+// SinkConfig names a configured metric sink instance and carries its
+// sink-specific configuration.
+type SinkConfig struct {
+	Name   string
+	Kind   string
+	Config interface{}
+}
+
+// MetricSinkTypeEntry describes how to construct and configure a kind
+// of metric sink.
+type MetricSinkTypeEntry struct {
+	Create func(
+		server *Server, name string, logger *logrus.Entry,
+		config Config, sinkConfig MetricSinkConfig,
+	) (sinks.MetricSink, error)
+	ParseConfig func(name string, config interface{}) (MetricSinkConfig, error)
+}
+
+// MetricSinkTypes maps a sink kind name to how to construct it.
+type MetricSinkTypes map[string]MetricSinkTypeEntry
+
+// ServerConfig bundles everything NewFromConfig needs to construct a
+// Server.
+type ServerConfig struct {
+	Logger          *logrus.Logger
+	Config          Config
+	MetricSinkTypes MetricSinkTypes
+}
+
+// ProxyConfig holds the configuration for a veneur.Proxy.
+type ProxyConfig struct {
+	Debug bool
+
+	ConsulRefreshInterval string
+
+	ConsulForwardServiceName   string
+	ConsulForwardServiceFilter string
+	ConsulTraceServiceName     string
+	ConsulTraceServiceFilter   string
+
+	TraceAddress    string
+	TraceAPIAddress string
+	HTTPAddress     string
+	GrpcAddress     string
+	StatsAddress    string
+
+	// GrpcForwardAddress is used as the Proxy's sole forwarding
+	// destination when Consul service discovery isn't configured for
+	// ConsulForwardServiceName.
+	GrpcForwardAddress string
+
+	// ForwardSessionsMin and ForwardSessionsMax bound the capacity
+	// SessionLimiter computes on every RefreshDestinations cycle.
+	ForwardSessionsMin int64
+	ForwardSessionsMax int64
+
+	// ForwardDialTimeout and ForwardRequestTimeout mirror
+	// grpcpool.Config's fields of the same name.
+	ForwardDialTimeout    time.Duration
+	ForwardRequestTimeout time.Duration
+
+	// RebalanceDrainInterval is how long keys whose owner changed
+	// during a RefreshDestinations cycle are marked as shadow traffic.
+	// See RebalancingRing.
+	RebalanceDrainInterval time.Duration
+}
@@ -0,0 +1,71 @@
+package veneur
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ConsulDestinationOpts controls how RefreshDestinations queries a
+// single Consul service when resolving forwarding destinations. It is
+// derived from the ProxyConfig fields ConsulForwardServiceFilter and
+// ConsulTraceServiceFilter, one instance per watched service.
+type ConsulDestinationOpts struct {
+	// Filter is a Consul filter expression
+	// (https://www.consul.io/api-docs/features/filtering), passed
+	// through verbatim as the filter= query parameter on
+	// /v1/health/service/<name>. An empty Filter means "no
+	// filtering", matching Consul's own default.
+	Filter string
+}
+
+// ValidateConsulFilter performs a cheap sanity check on a Consul
+// filter expression at startup, so that a malformed filter fails fast
+// during config parsing rather than silently matching zero hosts (or
+// every host) once RefreshDestinations starts polling. It does not
+// attempt to fully parse Consul's filter grammar; it only rejects the
+// empty-but-whitespace and unbalanced-parentheses cases that are
+// almost always typos.
+func ValidateConsulFilter(filter string) error {
+	if filter == "" {
+		return nil
+	}
+	if strings.TrimSpace(filter) == "" {
+		return fmt.Errorf("veneur: consul filter %q is only whitespace", filter)
+	}
+
+	depth := 0
+	for _, r := range filter {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth < 0 {
+			return fmt.Errorf("veneur: consul filter %q has an unmatched ')'", filter)
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("veneur: consul filter %q has an unmatched '('", filter)
+	}
+	return nil
+}
+
+// consulHealthServiceURL builds the /v1/health/service/<name> request
+// URL for a Consul agent at base, applying opts.Filter as the filter=
+// query parameter when it is non-empty.
+func consulHealthServiceURL(base, service string, opts ConsulDestinationOpts) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("veneur: invalid consul address %q: %w", base, err)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/v1/health/service/" + service
+
+	if opts.Filter != "" {
+		q := u.Query()
+		q.Set("filter", opts.Filter)
+		u.RawQuery = q.Encode()
+	}
+	return u, nil
+}
@@ -0,0 +1,52 @@
+package veneur
+
+import "testing"
+
+func TestValidateConsulFilterAcceptsEmpty(t *testing.T) {
+	if err := ValidateConsulFilter(""); err != nil {
+		t.Errorf("expected empty filter to be valid, got %v", err)
+	}
+}
+
+func TestValidateConsulFilterAcceptsWellFormedExpression(t *testing.T) {
+	filter := `Service.Tags contains "veneur-global" and not (Checks.Status == "warning")`
+	if err := ValidateConsulFilter(filter); err != nil {
+		t.Errorf("expected well-formed filter to be valid, got %v", err)
+	}
+}
+
+func TestValidateConsulFilterRejectsUnbalancedParens(t *testing.T) {
+	for _, filter := range []string{
+		`not (Checks.Status == "warning"`,
+		`not Checks.Status == "warning")`,
+	} {
+		if err := ValidateConsulFilter(filter); err == nil {
+			t.Errorf("expected filter %q to be rejected", filter)
+		}
+	}
+}
+
+func TestConsulHealthServiceURLAppliesFilter(t *testing.T) {
+	u, err := consulHealthServiceURL("http://127.0.0.1:8500", "forwardServiceName", ConsulDestinationOpts{
+		Filter: `Service.Tags contains "veneur-global"`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.Path != "/v1/health/service/forwardServiceName" {
+		t.Errorf("unexpected path: %s", u.Path)
+	}
+	if got := u.Query().Get("filter"); got != `Service.Tags contains "veneur-global"` {
+		t.Errorf("unexpected filter query param: %q", got)
+	}
+}
+
+func TestConsulHealthServiceURLOmitsFilterWhenEmpty(t *testing.T) {
+	u, err := consulHealthServiceURL("http://127.0.0.1:8500", "forwardServiceName", ConsulDestinationOpts{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.RawQuery != "" {
+		t.Errorf("expected no query string, got %q", u.RawQuery)
+	}
+}
@@ -86,6 +86,39 @@ func (rt *ConsulChangingRoundTripper) RoundTrip(req *http.Request) (*http.Respon
 	return rec.Result(), nil
 }
 
+// ConsulFilteredRoundTripper behaves like the real Consul agent when a
+// filter= query parameter is supplied: it returns the full two-host
+// response when unfiltered, and the narrowed one-host response when
+// any filter expression is present. It records the expression it saw
+// in FilterSeen for the test to check.
+type ConsulFilteredRoundTripper struct {
+	HealthGotCalled bool
+	FilterSeen      string
+}
+
+func (rt *ConsulFilteredRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	if req.URL.Path == "/v1/health/service/forwardServiceName" {
+		rt.HealthGotCalled = true
+		rt.FilterSeen = req.URL.Query().Get("filter")
+
+		var resp []byte
+		var err error
+		if rt.FilterSeen != "" {
+			resp, err = ioutil.ReadFile("testdata/health_service_two_filtered.json")
+		} else {
+			resp, err = ioutil.ReadFile("testdata/health_service_two.json")
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec.Write(resp)
+		rec.Code = http.StatusOK
+	}
+
+	return rec.Result(), nil
+}
+
 func TestConsulOneHost(t *testing.T) {
 	config := generateProxyConfig()
 	transport := &ConsulOneRoundTripper{}
@@ -135,3 +168,25 @@ func TestConsulChangingHosts(t *testing.T) {
 	assert.Contains(t, server.ForwardDestinations.Members(), "10.1.10.12:8000", "Got first member from Consul")
 	assert.Len(t, server.ForwardDestinations.Members(), 1, "One host host in ring")
 }
+
+// TestConsulForwardServiceFilterNarrowsHosts verifies that setting
+// ConsulForwardServiceFilter on ProxyConfig is forwarded to Consul as
+// the filter= query parameter, and that a filter which would
+// otherwise match two hosts correctly narrows the ring to one.
+func TestConsulForwardServiceFilterNarrowsHosts(t *testing.T) {
+	config := generateProxyConfig()
+	config.ConsulForwardServiceFilter = `Service.Tags contains "veneur-global" and not (Checks.Status == "warning")`
+
+	transport := &ConsulFilteredRoundTripper{}
+	server, err := veneur.NewProxyFromConfig(logrus.New(), config)
+	assert.NoError(t, err)
+
+	server.HTTPClient.Transport = transport
+
+	server.Start()
+	defer server.Shutdown()
+
+	assert.True(t, transport.HealthGotCalled, "Health Service got called")
+	assert.Equal(t, config.ConsulForwardServiceFilter, transport.FilterSeen, "Filter expression was sent to Consul")
+	assert.Equal(t, []string{"10.1.10.12:8000"}, server.ForwardDestinations.Members(), "Filter narrowed the ring to the matching host")
+}
@@ -0,0 +1,294 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/serialx/hashring"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// ForwardClientStats receives the counters ForwardClient emits for
+// observability (veneur.forward.retry, veneur.forward.evict).
+// Implementations typically wrap the Server's own statsd/trace
+// client.
+type ForwardClientStats interface {
+	Count(name string, value int64, tags []string)
+}
+
+// ForwardResolver looks up the current set of "host:port" addresses
+// for a forwarding target, whether that's a static list, a Consul
+// service name, or a DNS SRV record.
+type ForwardResolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// staticResolver implements ForwardResolver for a fixed list of
+// targets that never changes.
+type staticResolver struct {
+	targets []string
+}
+
+func (r staticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r.targets, nil
+}
+
+// StaticForwardResolver returns a ForwardResolver that always
+// resolves to the given fixed list of targets. Server uses it for the
+// addresses listed in Config.ForwardAddress.
+func StaticForwardResolver(targets []string) ForwardResolver {
+	return staticResolver{targets: targets}
+}
+
+// ForwardClientConfig configures a ForwardClient's target discovery
+// and failover behavior.
+type ForwardClientConfig struct {
+	// RefreshInterval is how often the client re-resolves its
+	// targets in the background. Defaults to 30s.
+	RefreshInterval time.Duration
+	// EvictionCooldown is how long an endpoint stays evicted from the
+	// ring after a retryable gRPC error. Defaults to 30s.
+	EvictionCooldown time.Duration
+	// RetryBudget is the maximum number of retry attempts for a
+	// single batch before giving up. Defaults to 3.
+	RetryBudget int
+	// RetryBaseDelay is the base delay used for exponential backoff
+	// between retries. Defaults to 100ms.
+	RetryBaseDelay time.Duration
+}
+
+func (c ForwardClientConfig) withDefaults() ForwardClientConfig {
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = 30 * time.Second
+	}
+	if c.EvictionCooldown <= 0 {
+		c.EvictionCooldown = 30 * time.Second
+	}
+	if c.RetryBudget <= 0 {
+		c.RetryBudget = 3
+	}
+	if c.RetryBaseDelay <= 0 {
+		c.RetryBaseDelay = 100 * time.Millisecond
+	}
+	return c
+}
+
+// ForwardClient maintains a consistent-hash ring of gRPC forwarding
+// targets, mirroring the Proxy's ForwardDestinations ring, and
+// transparently fails batches over to another member when a target
+// returns a retryable gRPC error.
+type ForwardClient struct {
+	config   ForwardClientConfig
+	resolver ForwardResolver
+	stats    ForwardClientStats
+
+	mu      sync.RWMutex
+	members []string
+	ring    *hashring.HashRing
+	evicted map[string]time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewForwardClient creates a ForwardClient that resolves its targets
+// via resolver and reports counters via stats. Call Start to begin the
+// background re-resolution loop.
+func NewForwardClient(
+	config ForwardClientConfig, resolver ForwardResolver, stats ForwardClientStats,
+) *ForwardClient {
+	return &ForwardClient{
+		config:   config.withDefaults(),
+		resolver: resolver,
+		stats:    stats,
+		ring:     hashring.New(nil),
+		evicted:  map[string]time.Time{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start resolves the initial set of targets and begins the background
+// re-resolution loop. It must be called at most once.
+func (c *ForwardClient) Start(ctx context.Context) error {
+	if err := c.refresh(ctx); err != nil {
+		return err
+	}
+	go c.refreshLoop()
+	return nil
+}
+
+// Stop halts the background re-resolution loop.
+func (c *ForwardClient) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
+func (c *ForwardClient) refreshLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			// Errors are transient network/Consul/DNS failures; keep
+			// the existing ring and try again next interval.
+			_ = c.refresh(context.Background())
+		}
+	}
+}
+
+// refresh re-resolves targets and swaps them into the ring, pruning
+// any eviction whose cooldown has since expired.
+func (c *ForwardClient) refresh(ctx context.Context) error {
+	targets, err := c.resolver.Resolve(ctx)
+	if err != nil {
+		return fmt.Errorf("veneur: failed to resolve forward targets: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members = targets
+	c.ring = hashring.New(targets)
+	now := time.Now()
+	for addr, evictedAt := range c.evicted {
+		if now.Sub(evictedAt) >= c.config.EvictionCooldown {
+			delete(c.evicted, addr)
+		}
+	}
+	return nil
+}
+
+// metricKeyHashKey derives the consistent-hash ring key for a
+// samplers.MetricKey, shared by ForwardClient and Proxy so that a
+// local Server and the Proxy it forwards through agree on which
+// destination owns any given metric.
+func metricKeyHashKey(key samplers.MetricKey) string {
+	return fmt.Sprintf("%s|%v|%s", key.Name, key.Type, key.JoinedTags)
+}
+
+// targetFor returns the live ring member owning key, skipping any
+// members currently evicted for cooldown. It returns ok=false if every
+// known member is currently evicted.
+func (c *ForwardClient) targetFor(key samplers.MetricKey) (addr string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	members := c.members
+	if len(members) == 0 {
+		return "", false
+	}
+
+	ring := c.ring
+	hashKey := metricKeyHashKey(key)
+	for attempt := 0; attempt < len(members); attempt++ {
+		node, found := ring.GetNode(hashKey)
+		if !found {
+			return "", false
+		}
+		if _, isEvicted := c.evicted[node]; !isEvicted {
+			return node, true
+		}
+		// Re-hash onto the ring with the rejected node removed so the
+		// next attempt lands on a different live member.
+		ring = ring.RemoveNode(node)
+	}
+	return "", false
+}
+
+// evict removes addr from consideration for EvictionCooldown.
+func (c *ForwardClient) evict(addr string) {
+	c.mu.Lock()
+	c.evicted[addr] = time.Now()
+	c.mu.Unlock()
+	if c.stats != nil {
+		c.stats.Count("veneur.forward.evict", 1, []string{"destination:" + addr})
+	}
+}
+
+// IsRetryable reports whether err is a gRPC status that ForwardClient
+// should fail the batch over for: the destination is unavailable,
+// overloaded, or didn't respond in time.
+func IsRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendBatch routes batch to the ring member owning key and invokes
+// send with that target. If send returns a retryable gRPC error (see
+// IsRetryable), the target is evicted for EvictionCooldown, the batch
+// is re-hashed onto the next live member, and the call is retried with
+// exponential backoff until RetryBudget is exhausted.
+func (c *ForwardClient) SendBatch(
+	ctx context.Context,
+	key samplers.MetricKey,
+	batch []samplers.InterMetric,
+	send func(ctx context.Context, addr string, batch []samplers.InterMetric) error,
+) error {
+	var lastErr error
+	for attempt := 0; attempt <= c.config.RetryBudget; attempt++ {
+		addr, ok := c.targetFor(key)
+		if !ok {
+			return fmt.Errorf("veneur: no live forward targets available for %s", key.Name)
+		}
+
+		err := send(ctx, addr, batch)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if !IsRetryable(err) {
+			return err
+		}
+
+		c.evict(addr)
+		if c.stats != nil {
+			c.stats.Count("veneur.forward.retry", 1, []string{"destination:" + addr})
+		}
+
+		if attempt == c.config.RetryBudget {
+			break
+		}
+		backoff := time.Duration(math.Pow(2, float64(attempt))) * c.config.RetryBaseDelay
+		jitter := time.Duration(rand.Int63n(int64(c.config.RetryBaseDelay) + 1))
+		select {
+		case <-time.After(backoff + jitter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fmt.Errorf("veneur: exhausted retry budget forwarding %s: %w", key.Name, lastErr)
+}
+
+// Members returns the current set of non-evicted forwarding targets.
+func (c *ForwardClient) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	all := c.members
+	live := make([]string, 0, len(all))
+	for _, addr := range all {
+		if _, isEvicted := c.evicted[addr]; !isEvicted {
+			live = append(live, addr)
+		}
+	}
+	return live
+}
@@ -0,0 +1,135 @@
+package veneur_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/stripe/veneur/v14"
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+type fakeForwardStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newFakeForwardStats() *fakeForwardStats {
+	return &fakeForwardStats{counts: map[string]int64{}}
+}
+
+func (s *fakeForwardStats) Count(name string, value int64, tags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[name] += value
+}
+
+func (s *fakeForwardStats) get(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[name]
+}
+
+func newTestForwardClient(t testing.TB, stats veneur.ForwardClientStats, targets ...string) *veneur.ForwardClient {
+	client := veneur.NewForwardClient(
+		veneur.ForwardClientConfig{
+			RetryBudget:    2,
+			RetryBaseDelay: time.Millisecond,
+		},
+		veneur.StaticForwardResolver(targets),
+		stats,
+	)
+	assert.NoError(t, client.Start(context.Background()))
+	return client
+}
+
+func TestForwardClientSendBatchSucceeds(t *testing.T) {
+	client := newTestForwardClient(t, nil, "a:1", "b:1")
+	defer client.Stop()
+
+	key := samplers.MetricKey{Name: "test.metric", Type: veneur.CounterTypeName}
+	var gotAddr string
+	err := client.SendBatch(context.Background(), key, nil, func(
+		ctx context.Context, addr string, batch []samplers.InterMetric,
+	) error {
+		gotAddr = addr
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"a:1", "b:1"}, gotAddr)
+}
+
+func TestForwardClientFailsOverOnRetryableError(t *testing.T) {
+	stats := newFakeForwardStats()
+	client := newTestForwardClient(t, stats, "a:1", "b:1")
+	defer client.Stop()
+
+	key := samplers.MetricKey{Name: "test.metric", Type: veneur.CounterTypeName}
+
+	var calls int
+	var firstAddr string
+	err := client.SendBatch(context.Background(), key, nil, func(
+		ctx context.Context, addr string, batch []samplers.InterMetric,
+	) error {
+		calls++
+		if calls == 1 {
+			firstAddr = addr
+			return status.Error(codes.Unavailable, "destination unreachable")
+		}
+		assert.NotEqual(t, firstAddr, addr, "retry should land on a different destination")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls, "expected one failed attempt and one successful retry")
+	assert.Equal(t, int64(1), stats.get("veneur.forward.retry"))
+	assert.Equal(t, int64(1), stats.get("veneur.forward.evict"))
+
+	// The failed destination should be evicted from Members() until
+	// its cooldown expires.
+	assert.Len(t, client.Members(), 1)
+}
+
+func TestForwardClientGivesUpOnNonRetryableError(t *testing.T) {
+	client := newTestForwardClient(t, nil, "a:1")
+	defer client.Stop()
+
+	key := samplers.MetricKey{Name: "test.metric", Type: veneur.CounterTypeName}
+	wantErr := status.Error(codes.InvalidArgument, "bad request")
+	err := client.SendBatch(context.Background(), key, nil, func(
+		ctx context.Context, addr string, batch []samplers.InterMetric,
+	) error {
+		return wantErr
+	})
+	assert.Equal(t, wantErr, err)
+}
+
+func TestForwardClientExhaustsRetryBudget(t *testing.T) {
+	// Use more targets than the retry budget so the client exhausts
+	// its retries while targets are still live, rather than running
+	// out of targets first.
+	client := newTestForwardClient(t, nil, "a:1", "b:1", "c:1", "d:1")
+	defer client.Stop()
+
+	key := samplers.MetricKey{Name: "test.metric", Type: veneur.CounterTypeName}
+	err := client.SendBatch(context.Background(), key, nil, func(
+		ctx context.Context, addr string, batch []samplers.InterMetric,
+	) error {
+		return status.Error(codes.Unavailable, "always down")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exhausted retry budget")
+}
+
+func TestIsRetryableClassifiesGRPCCodes(t *testing.T) {
+	assert.True(t, veneur.IsRetryable(status.Error(codes.Unavailable, "x")))
+	assert.True(t, veneur.IsRetryable(status.Error(codes.ResourceExhausted, "x")))
+	assert.True(t, veneur.IsRetryable(status.Error(codes.DeadlineExceeded, "x")))
+	assert.False(t, veneur.IsRetryable(status.Error(codes.InvalidArgument, "x")))
+	assert.False(t, veneur.IsRetryable(errors.New("not a grpc status")))
+}
@@ -0,0 +1,187 @@
+package veneur_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/v14"
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// consulMembersRoundTripper answers /v1/health/service/<name> requests
+// with whatever addresses are currently set on members, so a test can
+// change Consul's reported membership between RefreshDestinations
+// calls without needing a testdata fixture file per membership state.
+type consulMembersRoundTripper struct {
+	members []string
+}
+
+func (rt *consulMembersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	type entry struct {
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	entries := make([]entry, 0, len(rt.members))
+	for _, addr := range rt.members {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+		var e entry
+		e.Service.Address = host
+		e.Service.Port = port
+		entries = append(entries, e)
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	rec.Write(body)
+	rec.Code = http.StatusOK
+	return rec.Result(), nil
+}
+
+// consulRingHashKey replicates the unexported metricKeyHashKey format
+// from forward_client.go, which this external test package can't call
+// directly.
+func consulRingHashKey(key samplers.MetricKey) string {
+	return fmt.Sprintf("%s|%v|%s", key.Name, key.Type, key.JoinedTags)
+}
+
+// countEntry reports how many times name appears in metrics.
+func countEntry(metrics []samplers.InterMetric, name string) int {
+	n := 0
+	for _, m := range metrics {
+		if m.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// TestE2EConsulRebalanceDoesNotDuplicateOrDropGlobalOnlyMetric kills
+// one of two global Servers - simulating Consul observing it vanish
+// mid-flight - and verifies a GlobalOnly histogram metric whose owner
+// moves as a result is neither duplicated nor silently dropped at the
+// shared channel sink: the surviving owner emits exactly one ".count"
+// entry per generation of data, even though the killed owner will
+// never flush a primary sample for the survivor to merge with.
+func TestE2EConsulRebalanceDoesNotDuplicateOrDropGlobalOnlyMetric(t *testing.T) {
+	ch := make(chan []samplers.InterMetric, 32)
+
+	globalA, globalAAddr := newGlobalVeneur(t, ch)
+	defer globalA.Shutdown()
+	globalB, globalBAddr := newGlobalVeneur(t, ch)
+	defer globalB.Shutdown()
+
+	transport := &consulMembersRoundTripper{members: []string{globalAAddr, globalBAddr}}
+	proxyConfig := veneur.ProxyConfig{
+		HTTPAddress:              "127.0.0.1:0",
+		GrpcAddress:              unusedLocalTCPAddress(t),
+		ConsulForwardServiceName: "forwardServiceName",
+		ConsulRefreshInterval:    "86400s",
+		RebalanceDrainInterval:   200 * time.Millisecond,
+	}
+	proxy, err := veneur.NewProxyFromConfig(logrus.New(), proxyConfig)
+	assert.NoError(t, err)
+	proxy.HTTPClient.Transport = transport
+	proxy.Start()
+	defer proxy.Shutdown()
+	go func() { proxy.Serve() }()
+	waitForHTTPStart(t, proxy, 3*time.Second)
+
+	// Start's initial RefreshDestinations has no real "old" ring to
+	// diff against, so it marks every key as shadow for one drain
+	// window. Let that clear before the removal under test, so the
+	// removal is the only rebalance in play.
+	time.Sleep(400 * time.Millisecond)
+
+	// Find a metric name that the current two-member ring assigns to
+	// globalB, so removing globalB actually moves it.
+	var metricName string
+	key := samplers.MetricKey{Type: veneur.HistogramTypeName}
+	for i := 0; ; i++ {
+		key.Name = fmt.Sprintf("test.consul.rebalance.histogram.%d", i)
+		addr, shadow, ok := proxy.ForwardDestinations.Lookup(consulRingHashKey(key))
+		if ok && !shadow && addr == globalBAddr {
+			metricName = key.Name
+			break
+		}
+		if i > 1000 {
+			t.Fatal("could not find a metric name owned by globalB")
+		}
+	}
+
+	localConfig := generateConfig()
+	localConfig.ForwardAddress = proxyConfig.GrpcAddress
+	localConfig.ForwardUseGrpc = true
+	local := setupVeneurServer(t, localConfig)
+	defer local.Shutdown()
+
+	// First generation: routed straight to globalB, which owns it and
+	// isn't shadowing anything.
+	local.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  key,
+		Value:      20.0,
+		Digest:     12345,
+		SampleRate: 1.0,
+		Scope:      samplers.GlobalOnly,
+	})
+	assert.NoError(t, local.Flush(context.Background()))
+
+	assert.NoError(t, globalB.Flush(context.Background()))
+	firstFlush := <-ch
+	assert.Equal(t, 1, countEntry(firstFlush, metricName+".count"),
+		"globalB, the uncontested owner, flushes the first generation on its own")
+
+	// Consul observes globalB vanish; the ring moves this key to
+	// globalA, marked shadow for RebalanceDrainInterval. globalB is
+	// killed for good right after - it will never flush a primary
+	// sample at globalA for this key to merge with.
+	transport.members = []string{globalAAddr}
+	assert.NoError(t, proxy.RefreshDestinations(
+		proxyConfig.ConsulForwardServiceName, proxy.ForwardDestinations, &proxy.ForwardDestinationsMtx))
+	globalB.Shutdown()
+
+	addr, shadow, ok := proxy.ForwardDestinations.Lookup(consulRingHashKey(key))
+	assert.True(t, ok)
+	assert.Equal(t, globalAAddr, addr, "globalA is now the sole ring member")
+	assert.True(t, shadow, "the key just moved, so it's still within the drain window")
+
+	// Second generation: forwarded to globalA as shadow traffic, with
+	// no primary ever coming.
+	local.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  key,
+		Value:      40.0,
+		Digest:     54321,
+		SampleRate: 1.0,
+		Scope:      samplers.GlobalOnly,
+	})
+	assert.NoError(t, local.Flush(context.Background()))
+
+	assert.NoError(t, globalA.Flush(context.Background()))
+	secondFlush := <-ch
+	assert.Equal(t, 0, countEntry(secondFlush, metricName+".count"),
+		"globalA defers a shadow-only group on its first drain, waiting for a primary that will never come")
+
+	assert.NoError(t, globalA.Flush(context.Background()))
+	thirdFlush := <-ch
+	assert.Equal(t, 1, countEntry(thirdFlush, metricName+".count"),
+		"once the holdback is exhausted, globalA flushes the second generation on its own instead of dropping it forever")
+}
@@ -0,0 +1,124 @@
+package veneur_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/v14"
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// newGlobalVeneur creates a global-tier Server flushing to ch, bound
+// to its own gRPC address, and returns that address alongside it.
+func newGlobalVeneur(t testing.TB, ch chan []samplers.InterMetric) (*veneur.Server, string) {
+	config := generateConfig()
+	config.GrpcAddress = unusedLocalTCPAddress(t)
+	config.MetricSinks = []veneur.SinkConfig{{
+		Name:   "channel",
+		Kind:   "channel",
+		Config: ch,
+	}}
+	global := setupVeneurServer(t, config)
+	go func() { global.Serve() }()
+	waitForHTTPStart(t, global, 3*time.Second)
+	return global, config.GrpcAddress
+}
+
+// newProxyTo creates a Proxy that forwards everything it receives to
+// forwardAddr, and returns it alongside its own gRPC address.
+func newProxyTo(t testing.TB, forwardAddr string) (*veneur.Proxy, string) {
+	config := veneur.ProxyConfig{
+		HTTPAddress:        "127.0.0.1:0",
+		GrpcAddress:        unusedLocalTCPAddress(t),
+		GrpcForwardAddress: forwardAddr,
+	}
+	proxy, err := veneur.NewProxyFromConfig(logrus.New(), config)
+	assert.NoError(t, err)
+	go func() { proxy.Serve() }()
+	waitForHTTPStart(t, proxy, 3*time.Second)
+	return proxy, config.GrpcAddress
+}
+
+// TestE2EForwardingGRPCFailsOverToSecondGlobal configures a local
+// Server with two independent Proxy-to-global chains, kills the first
+// proxy before the local Server ever flushes through it, and verifies
+// that ForwardClient fails batches over to the second chain so they
+// still reach a global Server rather than being dropped.
+func TestE2EForwardingGRPCFailsOverToSecondGlobal(t *testing.T) {
+	ch := make(chan []samplers.InterMetric, 32)
+
+	globalA, globalAAddr := newGlobalVeneur(t, ch)
+	defer globalA.Shutdown()
+	globalB, globalBAddr := newGlobalVeneur(t, ch)
+	defer globalB.Shutdown()
+
+	proxyA, proxyAAddr := newProxyTo(t, globalAAddr)
+	proxyB, proxyBAddr := newProxyTo(t, globalBAddr)
+	defer proxyB.Shutdown()
+
+	// Kill the first leg of the chain before the local Server ever
+	// sends it anything, forcing every batch through it to fail over.
+	proxyA.Shutdown()
+
+	localConfig := generateConfig()
+	localConfig.ForwardAddress = proxyAAddr + "," + proxyBAddr
+	localConfig.ForwardUseGrpc = true
+	// Keep the dead proxyA's dial failure fast so failing over to
+	// proxyB fits comfortably inside this test's timeout.
+	localConfig.ForwardDialTimeout = 200 * time.Millisecond
+	local := setupVeneurServer(t, localConfig)
+	defer local.Shutdown()
+
+	// Ingest enough distinctly-named metrics that, regardless of how
+	// the consistent hash ring happens to split them between the two
+	// proxy addresses, at least some are first routed to the dead
+	// proxyA and must fail over to proxyB to arrive at all.
+	const metricCount = 16
+	want := map[string]bool{}
+	for i := 0; i < metricCount; i++ {
+		name := "test.failover.counter." + string(rune('a'+i))
+		want[name] = false
+		local.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: veneur.CounterTypeName},
+			Value:      1.0,
+			SampleRate: 1.0,
+			Scope:      samplers.GlobalOnly,
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			metrics := <-ch
+			for _, m := range metrics {
+				if _, ok := want[m.Name]; ok {
+					want[m.Name] = true
+				}
+			}
+			allSeen := true
+			for _, seen := range want {
+				if !seen {
+					allSeen = false
+					break
+				}
+			}
+			if allSeen {
+				return
+			}
+		}
+	}()
+
+	assert.NoError(t, local.Flush(context.Background()))
+	globalA.Flush(context.Background())
+	globalB.Flush(context.Background())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not every metric failed over to the second proxy/global chain within 5 seconds")
+	}
+}
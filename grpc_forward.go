@@ -0,0 +1,139 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// forwardCodecName is the gRPC content-subtype used for the Forward
+// service. Veneur has no protoc-generated stubs, so rather than wire
+// up a full protobuf toolchain for a single internal RPC, the client
+// and server both register gobCodec under this name and the client
+// forces it with grpc.CallContentSubtype.
+const forwardCodecName = "veneurgob"
+
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+	gob.Register(float64(0))
+	gob.Register("")
+}
+
+// gobCodec implements encoding.Codec by gob-encoding whatever struct
+// pointer it's given. It only ever needs to carry ForwardRequest and
+// ForwardResponse, so it doesn't attempt anything like protobuf's
+// schema evolution guarantees.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Name() string {
+	return forwardCodecName
+}
+
+// ForwardRequest carries a batch of samples sharing a single
+// MetricKey from a local Server to a Proxy, or from a Proxy onward to
+// a global Server.
+type ForwardRequest struct {
+	Metrics []samplers.UDPMetric
+}
+
+// ForwardResponse is currently empty; the RPC's only signal is
+// whether it returned an error.
+type ForwardResponse struct{}
+
+// forwardServer is implemented by anything that can accept a
+// forwarded batch: both Server (as a global forwarding target) and
+// Proxy (which relays onward) implement it.
+type forwardServer interface {
+	SendMetrics(ctx context.Context, req *ForwardRequest) (*ForwardResponse, error)
+}
+
+const forwardServiceName = "veneur.Forward"
+const forwardSendMetricsMethod = "SendMetrics"
+
+var forwardServiceDesc = grpc.ServiceDesc{
+	ServiceName: forwardServiceName,
+	HandlerType: (*forwardServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: forwardSendMetricsMethod,
+		Handler:    forwardSendMetricsHandler,
+	}},
+	Metadata: "veneur/forward.proto",
+}
+
+func forwardSendMetricsHandler(
+	srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor,
+) (interface{}, error) {
+	in := new(ForwardRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(forwardServer).SendMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + forwardServiceName + "/" + forwardSendMetricsMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(forwardServer).SendMetrics(ctx, req.(*ForwardRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// registerForwardServer registers srv's Forward handler on s.
+func registerForwardServer(s *grpc.Server, srv forwardServer) {
+	s.RegisterService(&forwardServiceDesc, srv)
+}
+
+// sendForwardBatch invokes the Forward service's SendMetrics RPC
+// against the connection from pool for addr, optionally attaching
+// shadow metadata.
+func sendForwardBatch(
+	ctx context.Context, pool interface {
+		Get(ctx context.Context, addr string) (*grpc.ClientConn, error)
+		RequestTimeout() time.Duration
+		RecordSuccess(addr string)
+		RecordFailure(addr string)
+	},
+	addr string, req *ForwardRequest, shadow bool,
+) error {
+	conn, err := pool.Get(ctx, addr)
+	if err != nil {
+		pool.RecordFailure(addr)
+		return err
+	}
+
+	if shadow {
+		ctx = WithShadowMetadata(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, pool.RequestTimeout())
+	defer cancel()
+
+	out := new(ForwardResponse)
+	err = conn.Invoke(ctx, "/"+forwardServiceName+"/"+forwardSendMetricsMethod, req, out,
+		grpc.CallContentSubtype(forwardCodecName))
+	if err != nil {
+		pool.RecordFailure(addr)
+		return err
+	}
+	pool.RecordSuccess(addr)
+	return nil
+}
@@ -0,0 +1,225 @@
+// Package grpcpool provides a lazily-dialing pool of gRPC client
+// connections keyed by destination address, shared across concurrent
+// callers. It is used by both veneur.Server (when ForwardAddress is
+// set) and veneur.Proxy (for GrpcForwardAddress and per-destination
+// forwarding) so that flushing to the same address never dials more
+// than one underlying HTTP/2 connection.
+package grpcpool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Config holds the tunables a Pool needs to dial and call its
+// destinations. These mirror the Config/ProxyConfig fields
+// ForwardDialTimeout and ForwardRequestTimeout.
+type Config struct {
+	// DialTimeout bounds how long a lazy dial may take before Get
+	// gives up and returns an error. Defaults to 5s.
+	DialTimeout time.Duration
+	// RequestTimeout is the default deadline Pool recommends callers
+	// apply to an individual RPC made over a pooled connection via
+	// RequestTimeout. Defaults to 10s.
+	RequestTimeout time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = 5 * time.Second
+	}
+	if c.RequestTimeout <= 0 {
+		c.RequestTimeout = 10 * time.Second
+	}
+	return c
+}
+
+// health tracks the outcome of RPCs made against a single pooled
+// connection, so that consumers like a session limiter or failover
+// client can make eviction decisions without instrumenting every RPC
+// call site themselves.
+type health struct {
+	mu                  sync.Mutex
+	lastSuccess         time.Time
+	consecutiveFailures int
+}
+
+func (h *health) recordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = time.Now()
+	h.consecutiveFailures = 0
+}
+
+func (h *health) recordFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consecutiveFailures++
+}
+
+func (h *health) snapshot() (lastSuccess time.Time, consecutiveFailures int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastSuccess, h.consecutiveFailures
+}
+
+// entry is the lazily-dialed connection for a single destination
+// address, along with its health bookkeeping.
+type entry struct {
+	dialOnce sync.Once
+	dialErr  error
+	conn     *grpc.ClientConn
+	health   health
+}
+
+// Pool is a lazily-dialing, goroutine-safe cache of *grpc.ClientConn
+// keyed by destination address. Each address gets at most one
+// connection, dialed on first Get and shared by every subsequent
+// caller until Close is called for that address.
+type Pool struct {
+	config      Config
+	dialOptions []grpc.DialOption
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// New creates an empty Pool. dialOptions are applied to every
+// connection the pool dials, in addition to a per-dial timeout derived
+// from config.DialTimeout. grpc.DialContext doesn't actually wait for
+// the connection to come up unless told to block, so New always adds
+// grpc.WithBlock itself - otherwise DialTimeout would never be
+// enforced and Get would return an unconnected conn immediately.
+func New(config Config, dialOptions ...grpc.DialOption) *Pool {
+	return &Pool{
+		config:      config.withDefaults(),
+		dialOptions: append(append([]grpc.DialOption{}, dialOptions...), grpc.WithBlock()),
+		entries:     map[string]*entry{},
+	}
+}
+
+// Get returns the shared *grpc.ClientConn for addr, dialing it lazily
+// if this is the first request for that address. Concurrent callers
+// requesting the same address block on the same dial and then share
+// its result.
+func (p *Pool) Get(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	e := p.entryFor(addr)
+
+	e.dialOnce.Do(func() {
+		dialCtx, cancel := context.WithTimeout(ctx, p.config.DialTimeout)
+		defer cancel()
+		e.conn, e.dialErr = grpc.DialContext(dialCtx, addr, p.dialOptions...)
+	})
+
+	if e.dialErr != nil {
+		// Reported as codes.Unavailable, not wrapped plainly, so that
+		// callers using IsRetryable-style classification (e.g.
+		// ForwardClient) treat an unreachable destination the same way
+		// they'd treat an RPC that failed after a successful dial.
+		return nil, status.Errorf(codes.Unavailable, "grpcpool: failed to dial %s: %v", addr, e.dialErr)
+	}
+	return e.conn, nil
+}
+
+func (p *Pool) entryFor(addr string) *entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[addr]
+	if !ok {
+		e = &entry{}
+		p.entries[addr] = e
+	}
+	return e
+}
+
+// RequestTimeout returns the per-RPC timeout callers should apply
+// when making requests over connections from this pool.
+func (p *Pool) RequestTimeout() time.Duration {
+	return p.config.RequestTimeout
+}
+
+// Close tears down and forgets the connection for addr, if one
+// exists. A subsequent Get for the same address dials a fresh
+// connection. It is a no-op if addr was never dialed.
+func (p *Pool) Close(addr string) error {
+	p.mu.Lock()
+	e, ok := p.entries[addr]
+	if ok {
+		delete(p.entries, addr)
+	}
+	p.mu.Unlock()
+
+	if !ok || e.conn == nil {
+		return nil
+	}
+	return e.conn.Close()
+}
+
+// Prune closes and forgets every pooled connection whose address is
+// not in keep. RefreshDestinations calls this after a ring change so
+// connections for removed members are torn down without disturbing
+// connections for retained ones.
+func (p *Pool) Prune(keep []string) {
+	keepSet := make(map[string]struct{}, len(keep))
+	for _, addr := range keep {
+		keepSet[addr] = struct{}{}
+	}
+
+	p.mu.Lock()
+	var stale []string
+	for addr := range p.entries {
+		if _, ok := keepSet[addr]; !ok {
+			stale = append(stale, addr)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, addr := range stale {
+		p.Close(addr)
+	}
+}
+
+// RecordSuccess notes that an RPC against addr's connection succeeded,
+// resetting its consecutive-failure count.
+func (p *Pool) RecordSuccess(addr string) {
+	p.entryFor(addr).health.recordSuccess()
+}
+
+// RecordFailure notes that an RPC against addr's connection failed,
+// incrementing its consecutive-failure count.
+func (p *Pool) RecordFailure(addr string) {
+	p.entryFor(addr).health.recordFailure()
+}
+
+// Health returns the last time an RPC against addr's connection
+// succeeded, and how many RPCs have failed in a row since then. ok is
+// false if the pool holds no entry for addr: neither Get,
+// RecordSuccess nor RecordFailure has been called for it since it was
+// last closed. An entry exists even if its dial failed.
+func (p *Pool) Health(addr string) (lastSuccess time.Time, consecutiveFailures int, ok bool) {
+	p.mu.Lock()
+	e, ok := p.entries[addr]
+	p.mu.Unlock()
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	lastSuccess, consecutiveFailures = e.health.snapshot()
+	return lastSuccess, consecutiveFailures, true
+}
+
+// Addrs returns the addresses currently holding a pooled entry,
+// dialed or not.
+func (p *Pool) Addrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addrs := make([]string, 0, len(p.entries))
+	for addr := range p.entries {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
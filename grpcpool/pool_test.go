@@ -0,0 +1,116 @@
+package grpcpool_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/stripe/veneur/v14/grpcpool"
+)
+
+// startTestServer starts a bare gRPC server (no registered services)
+// listening on the loopback interface and returns its address and a
+// func to stop it.
+func startTestServer(t testing.TB) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(ln)
+	return ln.Addr().String(), server.Stop
+}
+
+func newTestPool() *grpcpool.Pool {
+	return grpcpool.New(
+		grpcpool.Config{DialTimeout: 2 * time.Second},
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+}
+
+func TestPoolDialsLazilyAndReusesConnection(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	pool := newTestPool()
+	assert.Empty(t, pool.Addrs(), "pool should not dial anything until Get is called")
+
+	conn1, err := pool.Get(context.Background(), addr)
+	assert.NoError(t, err)
+	assert.Equal(t, connectivity.Ready, conn1.GetState())
+
+	conn2, err := pool.Get(context.Background(), addr)
+	assert.NoError(t, err)
+	assert.Same(t, conn1, conn2, "a second Get for the same address should reuse the dialed connection")
+}
+
+func TestPoolCloseEvictsAndRedialsOnNextGet(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	pool := newTestPool()
+	conn1, err := pool.Get(context.Background(), addr)
+	assert.NoError(t, err)
+
+	assert.NoError(t, pool.Close(addr))
+	assert.Empty(t, pool.Addrs())
+
+	conn2, err := pool.Get(context.Background(), addr)
+	assert.NoError(t, err)
+	assert.NotSame(t, conn1, conn2, "Close should force a fresh dial on the next Get")
+}
+
+func TestPoolPruneOnlyRemovesStaleAddresses(t *testing.T) {
+	keepAddr, stopKeep := startTestServer(t)
+	defer stopKeep()
+	staleAddr, stopStale := startTestServer(t)
+	defer stopStale()
+
+	pool := newTestPool()
+	keepConn, err := pool.Get(context.Background(), keepAddr)
+	assert.NoError(t, err)
+	_, err = pool.Get(context.Background(), staleAddr)
+	assert.NoError(t, err)
+
+	pool.Prune([]string{keepAddr})
+
+	assert.ElementsMatch(t, []string{keepAddr}, pool.Addrs())
+
+	keepConnAfter, err := pool.Get(context.Background(), keepAddr)
+	assert.NoError(t, err)
+	assert.Same(t, keepConn, keepConnAfter, "retained address's connection should not have been churned")
+}
+
+func TestPoolHealthTracksSuccessAndFailure(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	pool := newTestPool()
+	_, err := pool.Get(context.Background(), addr)
+	assert.NoError(t, err)
+
+	_, _, ok := pool.Health(addr)
+	assert.True(t, ok)
+
+	pool.RecordFailure(addr)
+	pool.RecordFailure(addr)
+	_, failures, _ := pool.Health(addr)
+	assert.Equal(t, 2, failures)
+
+	pool.RecordSuccess(addr)
+	lastSuccess, failures, _ := pool.Health(addr)
+	assert.Equal(t, 0, failures)
+	assert.WithinDuration(t, time.Now(), lastSuccess, time.Second)
+}
+
+func TestPoolHealthUnknownAddressIsNotOK(t *testing.T) {
+	pool := newTestPool()
+	_, _, ok := pool.Health("127.0.0.1:0")
+	assert.False(t, ok)
+}
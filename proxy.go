@@ -0,0 +1,367 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/stripe/veneur/v14/grpcpool"
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// consulAgentAddress is the local Consul agent Proxy queries for
+// service health. It is not presently part of ProxyConfig because
+// every deployment of Veneur runs its Proxy alongside a Consul agent
+// on localhost; tests instead swap out HTTPClient.Transport.
+const consulAgentAddress = "http://127.0.0.1:8500"
+
+const defaultRebalanceDrainInterval = 30 * time.Second
+const defaultConsulRefreshInterval = 30 * time.Second
+
+// Proxy sits between local Servers and the global tier. Local Servers
+// forward metrics to a Proxy over gRPC; the Proxy looks up each
+// metric's owning global Server in ForwardDestinations and relays the
+// batch onward.
+type Proxy struct {
+	config ProxyConfig
+	logger *logrus.Entry
+
+	HTTPClient *http.Client
+
+	// ForwardDestinations is the consistent-hash ring of global
+	// Server addresses, refreshed from Consul by RefreshDestinations.
+	// ForwardDestinationsMtx serializes concurrent refreshes (the
+	// background refresh loop and a test driving RefreshDestinations
+	// directly both take it).
+	ForwardDestinations    *RebalancingRing
+	ForwardDestinationsMtx sync.Mutex
+
+	// SessionLimiter caps concurrent inbound forwarding sessions,
+	// recomputed on every RefreshDestinations cycle.
+	SessionLimiter *SessionLimiter
+
+	// grpcPool holds lazily-dialed connections to ForwardDestinations'
+	// members, pruned to match the ring on every RefreshDestinations
+	// cycle.
+	grpcPool *grpcpool.Pool
+
+	listeningHTTP int32 // atomic bool
+
+	// listenMu guards httpListener/httpServer/grpcListener/grpcServer
+	// and shuttingDown: Serve assigns them from its own goroutine,
+	// concurrently with a caller that follows the documented
+	// go proxy.Serve(); ...; proxy.Shutdown() pattern, so unsynchronized
+	// access would race. shuttingDown lets Serve notice a Shutdown that
+	// won that race and close a listener it's about to bind instead of
+	// leaving it serving forever.
+	listenMu     sync.Mutex
+	httpListener net.Listener
+	httpServer   *http.Server
+	grpcListener net.Listener
+	grpcServer   *grpc.Server
+	shuttingDown bool
+
+	refreshInterval time.Duration
+	refreshStop     chan struct{}
+	refreshDone     chan struct{}
+
+	stopCh       chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewProxyFromConfig validates config and constructs a Proxy. It does
+// not start listening or do any network I/O; Start does the Consul
+// refresh and Serve binds the listeners.
+func NewProxyFromConfig(logger *logrus.Logger, config ProxyConfig) (*Proxy, error) {
+	if err := ValidateConsulFilter(config.ConsulForwardServiceFilter); err != nil {
+		return nil, fmt.Errorf("veneur: invalid ConsulForwardServiceFilter: %w", err)
+	}
+	if err := ValidateConsulFilter(config.ConsulTraceServiceFilter); err != nil {
+		return nil, fmt.Errorf("veneur: invalid ConsulTraceServiceFilter: %w", err)
+	}
+
+	if logger == nil {
+		logger = logrus.New()
+	}
+
+	drainInterval := config.RebalanceDrainInterval
+	if drainInterval <= 0 {
+		drainInterval = defaultRebalanceDrainInterval
+	}
+
+	var initial []string
+	if config.GrpcForwardAddress != "" {
+		initial = []string{config.GrpcForwardAddress}
+	}
+
+	refreshInterval := defaultConsulRefreshInterval
+	if config.ConsulRefreshInterval != "" {
+		parsed, err := time.ParseDuration(config.ConsulRefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("veneur: invalid ConsulRefreshInterval %q: %w", config.ConsulRefreshInterval, err)
+		}
+		refreshInterval = parsed
+	}
+
+	// refreshDone starts out already closed: Start only replaces it
+	// with a fresh channel if ConsulForwardServiceName is configured
+	// and a refreshLoop goroutine is actually launched, so Shutdown
+	// doesn't block waiting on a loop that never ran (Start is
+	// optional - a Proxy with only a static GrpcForwardAddress never
+	// calls it).
+	closedDone := make(chan struct{})
+	close(closedDone)
+
+	p := &Proxy{
+		config:              config,
+		logger:              logger.WithField("service", "veneur-proxy"),
+		HTTPClient:          &http.Client{Timeout: 10 * time.Second},
+		ForwardDestinations: NewRebalancingRing(initial, drainInterval),
+		SessionLimiter: NewSessionLimiter(SessionLimiterConfig{
+			MinSessions: config.ForwardSessionsMin,
+			MaxSessions: config.ForwardSessionsMax,
+		}),
+		grpcPool: grpcpool.New(
+			grpcpool.Config{DialTimeout: config.ForwardDialTimeout, RequestTimeout: config.ForwardRequestTimeout},
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		),
+		refreshInterval: refreshInterval,
+		refreshStop:     make(chan struct{}),
+		refreshDone:     closedDone,
+		stopCh:          make(chan struct{}),
+	}
+	return p, nil
+}
+
+// Start performs the initial Consul refresh (if ConsulForwardServiceName
+// is configured) and begins periodically refreshing in the
+// background. Binding and serving HTTP/gRPC traffic happens in Serve.
+func (p *Proxy) Start() {
+	if p.config.ConsulForwardServiceName == "" {
+		return
+	}
+	if err := p.RefreshDestinations(p.config.ConsulForwardServiceName, p.ForwardDestinations, &p.ForwardDestinationsMtx); err != nil {
+		p.logger.WithError(err).Error("veneur: initial consul refresh failed")
+	}
+	p.refreshDone = make(chan struct{})
+	go p.refreshLoop()
+}
+
+func (p *Proxy) refreshLoop() {
+	defer close(p.refreshDone)
+	ticker := time.NewTicker(p.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.refreshStop:
+			return
+		case <-ticker.C:
+			if err := p.RefreshDestinations(p.config.ConsulForwardServiceName, p.ForwardDestinations, &p.ForwardDestinationsMtx); err != nil {
+				p.logger.WithError(err).Error("veneur: consul refresh failed")
+			}
+		}
+	}
+}
+
+// Serve binds this Proxy's HTTP and (if configured) gRPC listeners,
+// serves on them in the background, and then blocks until Shutdown is
+// called.
+func (p *Proxy) Serve() {
+	httpListener, err := net.Listen("tcp", p.config.HTTPAddress)
+	if err != nil {
+		p.logger.WithError(err).Fatal("veneur: failed to bind http address")
+	}
+	httpServer := &http.Server{Handler: http.NewServeMux()}
+
+	p.listenMu.Lock()
+	if p.shuttingDown {
+		p.listenMu.Unlock()
+		httpListener.Close()
+		return
+	}
+	p.httpListener = httpListener
+	p.httpServer = httpServer
+	p.listenMu.Unlock()
+
+	go httpServer.Serve(httpListener)
+	atomic.StoreInt32(&p.listeningHTTP, 1)
+
+	if p.config.GrpcAddress != "" {
+		grpcListener, err := net.Listen("tcp", p.config.GrpcAddress)
+		if err != nil {
+			p.logger.WithError(err).Fatal("veneur: failed to bind grpc address")
+		}
+		grpcServer := grpc.NewServer()
+		registerForwardServer(grpcServer, p)
+
+		p.listenMu.Lock()
+		if p.shuttingDown {
+			p.listenMu.Unlock()
+			grpcListener.Close()
+		} else {
+			p.grpcListener = grpcListener
+			p.grpcServer = grpcServer
+			p.listenMu.Unlock()
+			go grpcServer.Serve(grpcListener)
+		}
+	}
+
+	<-p.stopCh
+}
+
+// IsListeningHTTP reports whether Serve has finished binding this
+// Proxy's HTTP listener.
+func (p *Proxy) IsListeningHTTP() bool {
+	return atomic.LoadInt32(&p.listeningHTTP) == 1
+}
+
+// Shutdown stops this Proxy's listeners and background refresh loop.
+// It is safe to call more than once.
+func (p *Proxy) Shutdown() {
+	p.shutdownOnce.Do(func() {
+		close(p.stopCh)
+		close(p.refreshStop)
+		<-p.refreshDone
+
+		p.listenMu.Lock()
+		p.shuttingDown = true
+		grpcServer, httpServer := p.grpcServer, p.httpServer
+		p.listenMu.Unlock()
+
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		if httpServer != nil {
+			httpServer.Close()
+		}
+	})
+}
+
+// consulHealthEntry is the subset of a Consul /v1/health/service/<name>
+// response entry that RefreshDestinations needs.
+type consulHealthEntry struct {
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// RefreshDestinations re-fetches serviceName's healthy hosts from
+// Consul, applying the configured filter (ConsulForwardServiceFilter
+// for serviceName == config.ConsulForwardServiceName,
+// ConsulTraceServiceFilter for config.ConsulTraceServiceName), and
+// updates ring with the result. When ring is p.ForwardDestinations,
+// this also reprices p.SessionLimiter's capacity.
+func (p *Proxy) RefreshDestinations(serviceName string, ring *RebalancingRing, mtx *sync.Mutex) error {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	var filter string
+	switch serviceName {
+	case p.config.ConsulForwardServiceName:
+		filter = p.config.ConsulForwardServiceFilter
+	case p.config.ConsulTraceServiceName:
+		filter = p.config.ConsulTraceServiceFilter
+	}
+
+	members, err := p.fetchConsulMembers(serviceName, ConsulDestinationOpts{Filter: filter})
+	if err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		// Consul reporting zero healthy hosts almost always means
+		// Consul itself is unhealthy or unreachable, not that every
+		// destination actually disappeared at once; keep the
+		// existing ring rather than draining it to nothing.
+		p.logger.WithField("service", serviceName).Warn(
+			"veneur: consul returned zero hosts, keeping previous destinations")
+		return nil
+	}
+
+	ring.Update(members)
+
+	if ring == p.ForwardDestinations {
+		// A cluster-wide estimate of session arrivals isn't available
+		// without a real stats backend; approximate it from this
+		// Proxy's own currently-live session count scaled by the
+		// number of healthy peers sharing the load.
+		arrivalRate := float64(p.SessionLimiter.Live()) * float64(len(members))
+		p.SessionLimiter.UpdateCapacity(arrivalRate, len(members))
+		p.grpcPool.Prune(members)
+	}
+	return nil
+}
+
+func (p *Proxy) fetchConsulMembers(serviceName string, opts ConsulDestinationOpts) ([]string, error) {
+	u, err := consulHealthServiceURL(consulAgentAddress, serviceName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("veneur: building consul request: %w", err)
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("veneur: querying consul for %q: %w", serviceName, err)
+	}
+	defer resp.Body.Close()
+
+	var entries []consulHealthEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("veneur: decoding consul response for %q: %w", serviceName, err)
+	}
+
+	members := make([]string, 0, len(entries))
+	for _, e := range entries {
+		members = append(members, fmt.Sprintf("%s:%d", e.Service.Address, e.Service.Port))
+	}
+	return members, nil
+}
+
+// SendMetrics implements the Forward gRPC service's inbound side: a
+// local Server calls this to hand off a batch, which this Proxy
+// relays to whichever global Server owns each metric's key.
+func (p *Proxy) SendMetrics(ctx context.Context, req *ForwardRequest) (*ForwardResponse, error) {
+	parent := ctx
+	ctx, release, err := p.SessionLimiter.Acquire(parent)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	groups := map[samplers.MetricKey][]samplers.UDPMetric{}
+	for _, m := range req.Metrics {
+		groups[m.MetricKey] = append(groups[m.MetricKey], m)
+	}
+
+	for key, samples := range groups {
+		addr, shadow, ok := p.ForwardDestinations.Lookup(metricKeyHashKey(key))
+		if !ok {
+			return nil, fmt.Errorf("veneur: no forward destinations available for %s", key.Name)
+		}
+
+		if err := sendForwardBatch(ctx, p.grpcPool, addr, &ForwardRequest{Metrics: samples}, shadow); err != nil {
+			if ctx.Err() != nil && parent.Err() == nil {
+				// SessionLimiter drained this session; report it as
+				// ResourceExhausted so the client fails over.
+				return nil, status.Error(codes.ResourceExhausted, "veneur: proxy session drained")
+			}
+			return nil, err
+		}
+	}
+	return &ForwardResponse{}, nil
+}
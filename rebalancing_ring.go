@@ -0,0 +1,143 @@
+package veneur
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/serialx/hashring"
+	"google.golang.org/grpc/metadata"
+)
+
+// ShadowMetadataKey is the gRPC metadata key a RebalancingRing
+// attaches to forwarded batches whose ownership changed during the
+// current rebalance window. A global Veneur that sees this key set to
+// ShadowMetadataValue folds the batch into its next flush's samplers
+// instead of emitting it independently, preventing double-counted
+// histograms while the ring is mid-transition.
+const ShadowMetadataKey = "x-veneur-shadow"
+
+// ShadowMetadataValue is the value ShadowMetadataKey is set to on a
+// shadowed request.
+const ShadowMetadataValue = "true"
+
+// RebalancingRing wraps a consistent-hash ring of forwarding
+// destinations and smooths over membership changes. For
+// RebalanceDrainInterval after a call to Update, keys whose owner
+// changed are routed to their new owner immediately (so the new
+// owner starts aggregating them right away) but are marked as
+// "shadow" traffic; the receiver is expected to merge shadow samples
+// into its next flush rather than emit them on their own, since the
+// previous owner may still be flushing its own, pre-rebalance view of
+// the same keys. Once the drain interval elapses, lookups stop being
+// marked as shadow.
+type RebalancingRing struct {
+	drainInterval time.Duration
+
+	mu         sync.RWMutex
+	oldRing    *hashring.HashRing // nil when no rebalance is in progress
+	newRing    *hashring.HashRing
+	newMembers []string
+	timer      *time.Timer
+}
+
+// NewRebalancingRing creates a RebalancingRing seeded with the given
+// initial members. No rebalance is in progress until Update is
+// called.
+func NewRebalancingRing(members []string, drainInterval time.Duration) *RebalancingRing {
+	return &RebalancingRing{
+		drainInterval: drainInterval,
+		newRing:       hashring.New(members),
+		newMembers:    members,
+	}
+}
+
+// Update replaces the ring's membership with newMembers. Any key whose
+// owner changes as a result is routed to its new owner immediately,
+// but Lookup reports it as shadow traffic until drainInterval has
+// elapsed since this call.
+func (r *RebalancingRing) Update(newMembers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	// The ring's view just before this update becomes the "old" side
+	// of the diff, replacing any earlier one still draining: if another
+	// Update arrives before the drain interval elapses, a key that
+	// moved only in the earlier update is no longer reported as shadow.
+	r.oldRing = r.newRing
+	r.newRing = hashring.New(newMembers)
+	r.newMembers = newMembers
+
+	r.timer = time.AfterFunc(r.drainInterval, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.oldRing = nil
+	})
+}
+
+// Lookup returns the destination address that owns key under the
+// ring's current membership, along with whether this is shadow
+// traffic: key's owner changed during the in-progress rebalance
+// window and the receiver should merge rather than independently
+// emit it.
+func (r *RebalancingRing) Lookup(key string) (addr string, shadow bool, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	newOwner, found := r.newRing.GetNode(key)
+	if !found {
+		return "", false, false
+	}
+
+	if r.oldRing == nil {
+		return newOwner, false, true
+	}
+
+	oldOwner, oldFound := r.oldRing.GetNode(key)
+	if oldFound && oldOwner == newOwner {
+		return newOwner, false, true
+	}
+	return newOwner, true, true
+}
+
+// Members returns the ring's current (post-rebalance) membership.
+func (r *RebalancingRing) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	members := make([]string, len(r.newMembers))
+	copy(members, r.newMembers)
+	return members
+}
+
+// Draining reports whether a rebalance window is currently in
+// progress.
+func (r *RebalancingRing) Draining() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.oldRing != nil
+}
+
+// WithShadowMetadata returns a context carrying outgoing gRPC metadata
+// marking the request as shadow traffic, per Lookup's shadow result.
+func WithShadowMetadata(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, ShadowMetadataKey, ShadowMetadataValue)
+}
+
+// IsShadowRequest reports whether the incoming gRPC metadata on ctx
+// marks this request as shadow traffic forwarded mid-rebalance.
+func IsShadowRequest(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, v := range md.Get(ShadowMetadataKey) {
+		if v == ShadowMetadataValue {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package veneur_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/stripe/veneur/v14"
+)
+
+func TestRebalancingRingLookupBeforeAnyUpdateIsNeverShadow(t *testing.T) {
+	ring := veneur.NewRebalancingRing([]string{"a:1", "b:1"}, time.Hour)
+
+	_, shadow, ok := ring.Lookup("some.metric.key")
+	assert.True(t, ok)
+	assert.False(t, shadow)
+	assert.False(t, ring.Draining())
+}
+
+func TestRebalancingRingMarksMovedKeysAsShadowDuringDrainWindow(t *testing.T) {
+	ring := veneur.NewRebalancingRing([]string{"a:1"}, time.Hour)
+
+	// With a single member, every key is owned by it.
+	owner, shadow, ok := ring.Lookup("some.metric.key")
+	assert.True(t, ok)
+	assert.False(t, shadow)
+	assert.Equal(t, "a:1", owner)
+
+	// Adding a second member may move ownership of some keys.
+	ring.Update([]string{"a:1", "b:1"})
+	assert.True(t, ring.Draining())
+
+	moved := false
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5", "k6", "k7", "k8"} {
+		newOwner, shadow, ok := ring.Lookup(key)
+		assert.True(t, ok)
+		if shadow {
+			moved = true
+			assert.Equal(t, "b:1", newOwner, "a shadowed key should have moved to the new member")
+		}
+	}
+	assert.True(t, moved, "expected at least one key to move to the new member and be shadowed")
+}
+
+func TestRebalancingRingStopsShadowingAfterDrainInterval(t *testing.T) {
+	ring := veneur.NewRebalancingRing([]string{"a:1"}, 20*time.Millisecond)
+	ring.Update([]string{"a:1", "b:1"})
+	assert.True(t, ring.Draining())
+
+	assert.Eventually(t, func() bool {
+		return !ring.Draining()
+	}, time.Second, 5*time.Millisecond)
+
+	_, shadow, ok := ring.Lookup("some.metric.key")
+	assert.True(t, ok)
+	assert.False(t, shadow, "lookups after the drain window should no longer be marked as shadow")
+}
+
+func TestRebalancingRingMembersReflectsLatestUpdate(t *testing.T) {
+	ring := veneur.NewRebalancingRing([]string{"a:1"}, time.Hour)
+	assert.Equal(t, []string{"a:1"}, ring.Members())
+
+	ring.Update([]string{"a:1", "b:1"})
+	assert.ElementsMatch(t, []string{"a:1", "b:1"}, ring.Members())
+}
+
+func TestShadowMetadataRoundTrip(t *testing.T) {
+	assert.False(t, veneur.IsShadowRequest(context.Background()))
+
+	// Carry the outgoing metadata over to the incoming side, as gRPC
+	// does between client and server.
+	md, ok := metadata.FromOutgoingContext(veneur.WithShadowMetadata(context.Background()))
+	assert.True(t, ok)
+	assert.True(t, veneur.IsShadowRequest(metadata.NewIncomingContext(context.Background(), md)))
+}
@@ -0,0 +1,51 @@
+// Package samplers defines the wire types Veneur uses to represent a
+// single ingested metric sample (UDPMetric), the identity used to
+// group samples together (MetricKey), and the flushed, aggregated
+// result of a group of samples (InterMetric).
+package samplers
+
+// Scope controls whether a metric is aggregated (and flushed) only on
+// the host that received it, only on the global tier it's forwarded
+// to, or on both.
+type Scope int
+
+const (
+	// LocalOnly metrics are aggregated and flushed locally and are
+	// never forwarded.
+	LocalOnly Scope = iota
+	// GlobalOnly metrics are forwarded to the global tier and flushed
+	// there; they are not flushed locally.
+	GlobalOnly
+	// MixedScope metrics are aggregated and flushed locally, and
+	// percentile-bearing types (histograms, timers) are additionally
+	// forwarded so the global tier can compute percentiles across
+	// every host's samples.
+	MixedScope
+)
+
+// MetricKey identifies a group of samples that should be aggregated
+// together: same name, same metric type, same tag set.
+type MetricKey struct {
+	Name       string
+	Type       string
+	JoinedTags string
+}
+
+// UDPMetric is a single ingested metric sample.
+type UDPMetric struct {
+	MetricKey
+
+	Value      interface{}
+	Digest     uint32
+	SampleRate float64
+	Scope      Scope
+}
+
+// InterMetric is a flushed, aggregated metric ready to hand to a
+// MetricSink.
+type InterMetric struct {
+	Name      string
+	Value     interface{}
+	Tags      []string
+	Timestamp int64
+}
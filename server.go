@@ -0,0 +1,262 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/stripe/veneur/v14/grpcpool"
+	"github.com/stripe/veneur/v14/samplers"
+	"github.com/stripe/veneur/v14/sinks"
+	"github.com/stripe/veneur/v14/trace"
+)
+
+// sinkEntry names a configured MetricSink instance.
+type sinkEntry struct {
+	name string
+	sink sinks.MetricSink
+}
+
+// Server is a single local or global Veneur instance: it ingests
+// metrics into its Workers, and on each Flush either hands them to
+// its own MetricSinks or forwards them on towards the global tier,
+// depending on each metric's samplers.Scope.
+type Server struct {
+	config Config
+	logger *logrus.Entry
+
+	Workers     []*Worker
+	TraceClient *trace.Client
+
+	sinkEntries []sinkEntry
+
+	// grpcPool and forwardClient are non-nil only when
+	// Config.ForwardAddress is set, i.e. this Server isn't the
+	// terminal, global tier.
+	grpcPool      *grpcpool.Pool
+	forwardClient *ForwardClient
+
+	httpListener  net.Listener
+	httpServer    *http.Server
+	listeningHTTP int32 // atomic bool
+
+	grpcListener net.Listener
+	grpcServer   *grpc.Server
+
+	stopCh       chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewFromConfig constructs a Server from sc, including its Workers and
+// configured MetricSinks. It does not start listening; call Start for
+// that.
+func NewFromConfig(sc ServerConfig) (*Server, error) {
+	config := sc.Config
+	if config.NumWorkers < 1 {
+		config.NumWorkers = 1
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultFlushInterval
+	}
+
+	logger := sc.Logger
+	if logger == nil {
+		logger = logrus.New()
+	}
+
+	s := &Server{
+		config:      config,
+		logger:      logger.WithField("service", "veneur"),
+		TraceClient: &trace.Client{},
+		stopCh:      make(chan struct{}),
+	}
+
+	for i := 0; i < config.NumWorkers; i++ {
+		s.Workers = append(s.Workers, NewWorker())
+	}
+
+	for _, sinkConfig := range config.MetricSinks {
+		sinkType, ok := sc.MetricSinkTypes[sinkConfig.Kind]
+		if !ok {
+			return nil, fmt.Errorf("veneur: unknown metric sink kind %q for sink %q", sinkConfig.Kind, sinkConfig.Name)
+		}
+		parsedConfig, err := sinkType.ParseConfig(sinkConfig.Name, sinkConfig.Config)
+		if err != nil {
+			return nil, fmt.Errorf("veneur: parsing config for sink %q: %w", sinkConfig.Name, err)
+		}
+		sink, err := sinkType.Create(
+			s, sinkConfig.Name, s.logger.WithField("sink", sinkConfig.Name), config, parsedConfig)
+		if err != nil {
+			return nil, fmt.Errorf("veneur: creating sink %q: %w", sinkConfig.Name, err)
+		}
+		s.sinkEntries = append(s.sinkEntries, sinkEntry{name: sinkConfig.Name, sink: sink})
+	}
+
+	if config.ForwardAddress != "" {
+		targets := splitAddresses(config.ForwardAddress)
+		s.grpcPool = grpcpool.New(
+			grpcpool.Config{DialTimeout: config.ForwardDialTimeout, RequestTimeout: config.ForwardRequestTimeout},
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		s.forwardClient = NewForwardClient(ForwardClientConfig{}, StaticForwardResolver(targets), nil)
+	}
+
+	return s, nil
+}
+
+// splitAddresses splits a comma-separated list of "host:port" targets,
+// trimming whitespace and dropping empty entries. Config.ForwardAddress
+// uses this format so a Server can be configured with more than one
+// forwarding target (e.g. two Proxy replicas) for failover.
+func splitAddresses(addrs string) []string {
+	var out []string
+	for _, part := range strings.Split(addrs, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// Start binds this Server's HTTP and (if configured) gRPC listeners
+// and begins serving on them in the background, and starts the
+// forwarding client's destination refresh loop if forwarding is
+// configured. It does not block; use Serve for that.
+func (s *Server) Start() {
+	if s.forwardClient != nil {
+		if err := s.forwardClient.Start(context.Background()); err != nil {
+			s.logger.WithError(err).Error("veneur: failed to start forward client")
+		}
+	}
+
+	httpListener, err := net.Listen("tcp", s.config.HTTPAddress)
+	if err != nil {
+		s.logger.WithError(err).Fatal("veneur: failed to bind http address")
+	}
+	s.httpListener = httpListener
+	s.httpServer = &http.Server{Handler: http.NewServeMux()}
+	atomic.StoreInt32(&s.listeningHTTP, 1)
+	go s.httpServer.Serve(httpListener)
+
+	if s.config.GrpcAddress != "" {
+		grpcListener, err := net.Listen("tcp", s.config.GrpcAddress)
+		if err != nil {
+			s.logger.WithError(err).Fatal("veneur: failed to bind grpc address")
+		}
+		s.grpcListener = grpcListener
+		s.grpcServer = grpc.NewServer()
+		registerForwardServer(s.grpcServer, s)
+		go s.grpcServer.Serve(grpcListener)
+	}
+}
+
+// Serve blocks until Shutdown is called. Start has already begun
+// serving requests by the time it returns, so Serve exists only to
+// give callers something to run in a blocking goroutine.
+func (s *Server) Serve() {
+	<-s.stopCh
+}
+
+// IsListeningHTTP reports whether Start has finished binding this
+// Server's HTTP listener.
+func (s *Server) IsListeningHTTP() bool {
+	return atomic.LoadInt32(&s.listeningHTTP) == 1
+}
+
+// Shutdown stops this Server's listeners and forwarding client. It is
+// safe to call more than once.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.stopCh)
+		if s.grpcServer != nil {
+			s.grpcServer.GracefulStop()
+		}
+		if s.httpServer != nil {
+			s.httpServer.Close()
+		}
+		if s.forwardClient != nil {
+			s.forwardClient.Stop()
+		}
+	})
+}
+
+// workerFor picks the Worker that owns key, so that every sample for
+// a given MetricKey is aggregated by the same Worker regardless of
+// whether it arrived via ProcessMetric or a forwarded batch.
+func (s *Server) workerFor(key samplers.MetricKey) *Worker {
+	h := fnv.New32a()
+	h.Write([]byte(key.Name))
+	return s.Workers[h.Sum32()%uint32(len(s.Workers))]
+}
+
+// SendMetrics implements the Forward gRPC service's inbound side,
+// letting this Server act as a forwarding target for a Proxy (or,
+// directly, another Server).
+func (s *Server) SendMetrics(ctx context.Context, req *ForwardRequest) (*ForwardResponse, error) {
+	shadow := IsShadowRequest(ctx)
+	for _, m := range req.Metrics {
+		s.workerFor(m.MetricKey).processForwarded(m, shadow)
+	}
+	return &ForwardResponse{}, nil
+}
+
+// Flush drains every Worker. LocalOnly and MixedScope groups are
+// aggregated and handed to this Server's own MetricSinks; GlobalOnly
+// groups, and the percentile-bearing subset of MixedScope groups, are
+// also (or, for GlobalOnly on a non-terminal Server, only) forwarded
+// to ForwardAddress so the global tier can aggregate across every
+// host that reported that metric.
+func (s *Server) Flush(ctx context.Context) error {
+	merged := map[samplers.MetricKey][]samplers.UDPMetric{}
+	for _, w := range s.Workers {
+		for key, samples := range w.drain() {
+			merged[key] = append(merged[key], samples...)
+		}
+	}
+
+	var toFlush []samplers.InterMetric
+	for key, samples := range merged {
+		scope := samples[0].Scope
+		forward := s.forwardClient != nil &&
+			(scope == samplers.GlobalOnly || (scope == samplers.MixedScope && isForwardableType(key)))
+		if forward {
+			if err := s.forwardSamples(ctx, key, samples); err != nil {
+				s.logger.WithError(err).WithField("metric", key.Name).Error("veneur: failed to forward metric")
+			}
+		}
+
+		// A Server with somewhere to forward GlobalOnly metrics to
+		// never flushes them itself; only the terminal, global tier
+		// (forwardClient == nil) does.
+		if scope == samplers.GlobalOnly && s.forwardClient != nil {
+			continue
+		}
+		toFlush = append(toFlush, aggregate(s.config, key, samples, scope == samplers.GlobalOnly)...)
+	}
+
+	for _, entry := range s.sinkEntries {
+		if err := entry.sink.Flush(ctx, toFlush); err != nil {
+			return fmt.Errorf("veneur: sink %q: %w", entry.name, err)
+		}
+	}
+	return nil
+}
+
+// forwardSamples sends samples on towards ForwardAddress, routed and
+// failed over by s.forwardClient and transported over s.grpcPool.
+func (s *Server) forwardSamples(ctx context.Context, key samplers.MetricKey, samples []samplers.UDPMetric) error {
+	req := &ForwardRequest{Metrics: samples}
+	return s.forwardClient.SendBatch(ctx, key, nil, func(ctx context.Context, addr string, _ []samplers.InterMetric) error {
+		return sendForwardBatch(ctx, s.grpcPool, addr, req, false)
+	})
+}
@@ -0,0 +1,226 @@
+package veneur
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sessionLimiterEWMAAlpha is the smoothing factor applied to the
+// cluster-wide session-arrival rate that SessionLimiter uses to size
+// its capacity. Lower values smooth out bursts across more
+// RefreshDestinations cycles at the cost of reacting more slowly to
+// sustained load changes.
+const sessionLimiterEWMAAlpha = 0.3
+
+// SessionLimiterConfig holds the tunables a SessionLimiter needs to
+// translate cluster-wide load into a local capacity. These mirror the
+// ProxyConfig fields of the same name (ForwardSessionsMin,
+// ForwardSessionsMax).
+type SessionLimiterConfig struct {
+	// MinSessions is the smallest capacity the limiter will ever
+	// compute, even if the cluster reports little to no load.
+	MinSessions int64
+	// MaxSessions is the largest capacity the limiter will ever
+	// compute, protecting a single proxy from absorbing an entire
+	// cluster's worth of sessions when peers disappear.
+	MaxSessions int64
+}
+
+// trackedSession is the bookkeeping SessionLimiter keeps for each live
+// gRPC forwarding session so that it can be cancelled later if the
+// limiter's capacity drops.
+type trackedSession struct {
+	id     uint64
+	cancel context.CancelFunc
+}
+
+// SessionLimiter caps the number of concurrent inbound gRPC forwarding
+// sessions a Proxy (or global Server acting as a forwarding target)
+// will accept. Its capacity is recomputed on every RefreshDestinations
+// call from a smoothed estimate of cluster-wide session arrivals, and
+// it drains the oldest sessions above capacity by cancelling their
+// gRPC contexts with codes.ResourceExhausted so well-behaved clients
+// reconnect to another member of the ring.
+type SessionLimiter struct {
+	config SessionLimiterConfig
+
+	capacity int64 // atomic
+	live     int64 // atomic
+
+	mu       sync.Mutex
+	sessions []trackedSession
+	nextID   uint64
+	ewmaLoad float64
+	haveEWMA bool
+}
+
+// NewSessionLimiter creates a SessionLimiter with the given
+// configuration. The limiter starts out unrestricted (at MaxSessions,
+// or effectively unlimited if MaxSessions is unset) until the first
+// call to UpdateCapacity, so a proxy doesn't start rejecting sessions
+// before it has learned the cluster's real load.
+func NewSessionLimiter(config SessionLimiterConfig) *SessionLimiter {
+	capacity := config.MaxSessions
+	if capacity <= 0 {
+		capacity = math.MaxInt64
+	}
+	return &SessionLimiter{
+		config:   config,
+		capacity: capacity,
+	}
+}
+
+// Acquire reserves a slot for a new inbound forwarding session derived
+// from parent. If the limiter is already at capacity it returns a
+// codes.ResourceExhausted error with a nil ctx and release. Otherwise it
+// returns a context that SessionLimiter may cancel later if capacity
+// shrinks, along with a release function the caller must call exactly
+// once when the session ends.
+func (l *SessionLimiter) Acquire(parent context.Context) (ctx context.Context, release func(), err error) {
+	if atomic.LoadInt64(&l.live) >= atomic.LoadInt64(&l.capacity) {
+		return nil, nil, status.Error(codes.ResourceExhausted, "veneur: proxy session limit reached")
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+
+	l.mu.Lock()
+	id := l.nextID
+	l.nextID++
+	l.sessions = append(l.sessions, trackedSession{id: id, cancel: cancel})
+	l.mu.Unlock()
+
+	atomic.AddInt64(&l.live, 1)
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			// Drain has already decremented live for a drained session.
+			if l.removeSession(id) {
+				atomic.AddInt64(&l.live, -1)
+			}
+			cancel()
+		})
+	}
+	return ctx, release, nil
+}
+
+// removeSession drops the bookkeeping for id, if it is still present,
+// and reports whether it was. It is a no-op if the session has already
+// been drained or released.
+func (l *SessionLimiter) removeSession(id uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, s := range l.sessions {
+		if s.id == id {
+			l.sessions = append(l.sessions[:i], l.sessions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateCapacity recomputes the limiter's capacity from the observed
+// arrivalRate (sessions/interval, cluster-wide) and the number of
+// healthy servers sharing that load, smoothing arrivalRate with an
+// EWMA so a single noisy RefreshDestinations cycle doesn't thrash the
+// limiter. The result is clamped to [MinSessions, MaxSessions]. If the
+// new capacity is lower than the current live session count, the
+// oldest excess sessions are drained via Drain.
+func (l *SessionLimiter) UpdateCapacity(arrivalRate float64, healthyServers int) int64 {
+	l.mu.Lock()
+	if !l.haveEWMA {
+		l.ewmaLoad = arrivalRate
+		l.haveEWMA = true
+	} else {
+		l.ewmaLoad = sessionLimiterEWMAAlpha*arrivalRate + (1-sessionLimiterEWMAAlpha)*l.ewmaLoad
+	}
+	smoothed := l.ewmaLoad
+	l.mu.Unlock()
+
+	if healthyServers < 1 {
+		healthyServers = 1
+	}
+
+	capacity := int64(math.Ceil(smoothed / float64(healthyServers)))
+	// An unset (<= 0) MinSessions still floors capacity at 1: without
+	// it, a quiet cluster (or simply the very first refresh, before
+	// any traffic has arrived to report) drives capacity to 0, which
+	// permanently wedges the limiter since Live() can then never rise
+	// to produce a nonzero arrivalRate on a later cycle.
+	minSessions := l.config.MinSessions
+	if minSessions <= 0 {
+		minSessions = 1
+	}
+	if capacity < minSessions {
+		capacity = minSessions
+	}
+	if l.config.MaxSessions > 0 && capacity > l.config.MaxSessions {
+		capacity = l.config.MaxSessions
+	}
+
+	atomic.StoreInt64(&l.capacity, capacity)
+	l.Drain(capacity)
+	return capacity
+}
+
+// Drain cancels live sessions, selected from among the oldest, until
+// at most capacity remain live. It is safe to call concurrently with
+// Acquire; a session released concurrently is simply skipped.
+func (l *SessionLimiter) Drain(capacity int64) {
+	l.mu.Lock()
+	live := int64(len(l.sessions))
+	excess := live - capacity
+	if excess <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	// Bias towards draining the oldest sessions, but jitter the exact
+	// choice within a window so we don't always evict the single
+	// longest-lived session across every cluster member in lockstep.
+	window := excess * 2
+	if window > live {
+		window = live
+	}
+	candidates := append([]trackedSession(nil), l.sessions[:window]...)
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if int64(len(candidates)) > excess {
+		candidates = candidates[:excess]
+	}
+
+	drop := make(map[uint64]struct{}, len(candidates))
+	for _, s := range candidates {
+		drop[s.id] = struct{}{}
+	}
+	remaining := l.sessions[:0:0]
+	for _, s := range l.sessions {
+		if _, ok := drop[s.id]; !ok {
+			remaining = append(remaining, s)
+		}
+	}
+	l.sessions = remaining
+	l.mu.Unlock()
+
+	for _, s := range candidates {
+		atomic.AddInt64(&l.live, -1)
+		s.cancel()
+	}
+}
+
+// Capacity returns the limiter's current computed capacity.
+func (l *SessionLimiter) Capacity() int64 {
+	return atomic.LoadInt64(&l.capacity)
+}
+
+// Live returns the current number of live, un-drained sessions.
+func (l *SessionLimiter) Live() int64 {
+	return atomic.LoadInt64(&l.live)
+}
@@ -0,0 +1,105 @@
+package veneur_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/stripe/veneur/v14"
+)
+
+func TestSessionLimiterAcquireWithinCapacity(t *testing.T) {
+	limiter := veneur.NewSessionLimiter(veneur.SessionLimiterConfig{
+		MinSessions: 2,
+		MaxSessions: 10,
+	})
+
+	ctx, release, err := limiter.Acquire(context.Background())
+	assert.NoError(t, err)
+	assert.NotNil(t, ctx)
+	assert.Equal(t, int64(1), limiter.Live())
+
+	release()
+	assert.Equal(t, int64(0), limiter.Live())
+}
+
+func TestSessionLimiterRejectsOverCapacity(t *testing.T) {
+	limiter := veneur.NewSessionLimiter(veneur.SessionLimiterConfig{
+		MinSessions: 1,
+		MaxSessions: 1,
+	})
+
+	_, release, err := limiter.Acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+
+	_, _, err = limiter.Acquire(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestSessionLimiterUpdateCapacityDrainsExcessSessions(t *testing.T) {
+	limiter := veneur.NewSessionLimiter(veneur.SessionLimiterConfig{
+		MinSessions: 1,
+		MaxSessions: 10,
+	})
+
+	var releases []func()
+	var ctxs []context.Context
+	for i := 0; i < 4; i++ {
+		ctx, release, err := limiter.Acquire(context.Background())
+		assert.NoError(t, err)
+		releases = append(releases, release)
+		ctxs = append(ctxs, ctx)
+	}
+	assert.Equal(t, int64(4), limiter.Live())
+
+	// Simulate a RefreshDestinations cycle observing that the cluster
+	// only needs 1 session per server now.
+	capacity := limiter.UpdateCapacity(1, 1)
+	assert.Equal(t, int64(1), capacity)
+	assert.Equal(t, int64(1), limiter.Live())
+
+	cancelled := 0
+	for _, ctx := range ctxs {
+		select {
+		case <-ctx.Done():
+			cancelled++
+		default:
+		}
+	}
+	assert.Equal(t, 3, cancelled, "expected the excess sessions to have their contexts cancelled")
+
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestSessionLimiterUpdateCapacityRespectsFloorAndCeiling(t *testing.T) {
+	limiter := veneur.NewSessionLimiter(veneur.SessionLimiterConfig{
+		MinSessions: 5,
+		MaxSessions: 20,
+	})
+
+	assert.Equal(t, int64(5), limiter.UpdateCapacity(0, 10))
+	assert.Equal(t, int64(20), limiter.UpdateCapacity(10000, 1))
+}
+
+func TestSessionLimiterReleaseIsIdempotent(t *testing.T) {
+	limiter := veneur.NewSessionLimiter(veneur.SessionLimiterConfig{MinSessions: 1, MaxSessions: 1})
+
+	_, release, err := limiter.Acquire(context.Background())
+	assert.NoError(t, err)
+
+	release()
+	release()
+	assert.Equal(t, int64(0), limiter.Live())
+
+	// A fresh session should immediately be acceptable again.
+	_, release2, err := limiter.Acquire(context.Background())
+	assert.NoError(t, err)
+	release2()
+}
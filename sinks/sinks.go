@@ -0,0 +1,16 @@
+// Package sinks defines the interface a metric sink must implement to
+// receive flushed metrics from a veneur.Server.
+package sinks
+
+import (
+	"context"
+
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// MetricSink receives the InterMetric batch a Server produces each
+// flush interval.
+type MetricSink interface {
+	Name() string
+	Flush(ctx context.Context, metrics []samplers.InterMetric) error
+}
@@ -0,0 +1,16 @@
+package veneur
+
+import "time"
+
+// Metric type names, as used in samplers.MetricKey.Type.
+const (
+	CounterTypeName   = "counter"
+	GaugeTypeName     = "gauge"
+	HistogramTypeName = "histogram"
+	TimerTypeName     = "timer"
+	SetTypeName       = "set"
+)
+
+// DefaultFlushInterval is the flush interval Config.Interval defaults
+// to when a config does not set one explicitly.
+const DefaultFlushInterval = 10 * time.Second
@@ -0,0 +1,11 @@
+// Package util holds small shared types used across Veneur's config.
+package util
+
+import "net/url"
+
+// Url wraps url.URL so it can be parsed from and flag-compatible with
+// plain string config values while still being usable as a structured
+// URL elsewhere.
+type Url struct {
+	Value *url.URL
+}
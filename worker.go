@@ -0,0 +1,108 @@
+package veneur
+
+import (
+	"sync"
+
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// workerSample pairs an ingested sample with whether it arrived as
+// shadow traffic: a forwarded batch whose destination changed mid
+// rebalance, per RebalancingRing.
+type workerSample struct {
+	metric samplers.UDPMetric
+	shadow bool
+}
+
+// shadowOnlyHoldbackDrains is how many consecutive drain calls a
+// shadow-only group may be held back for before it is force-flushed
+// regardless of whether a primary ever arrived. This bounds the
+// holdback in drain to one extra flush cycle: long enough for a
+// replica that is still flushing its pre-rebalance view to catch up,
+// but not so long that a key whose old owner is simply gone for good
+// (not just slow) gets silently dropped forever.
+const shadowOnlyHoldbackDrains = 1
+
+// Worker accumulates ingested metric samples between flushes. A
+// Server has Config.NumWorkers of these, each owning a disjoint shard
+// of the metric key space in a full implementation; for simplicity
+// each Worker here stores whatever is routed to it.
+type Worker struct {
+	mu      sync.Mutex
+	samples map[samplers.MetricKey][]workerSample
+	// deferred counts how many consecutive drain calls have held back
+	// each still-shadow-only key, so drain knows when to give up on
+	// waiting for a primary and flush anyway.
+	deferred map[samplers.MetricKey]int
+}
+
+// NewWorker creates an empty Worker.
+func NewWorker() *Worker {
+	return &Worker{
+		samples:  map[samplers.MetricKey][]workerSample{},
+		deferred: map[samplers.MetricKey]int{},
+	}
+}
+
+// ProcessMetric records a single directly-ingested sample, grouping
+// it with any other samples sharing its MetricKey.
+func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
+	w.ingest(*m, false)
+}
+
+// processForwarded records a sample that arrived via the Forward gRPC
+// service rather than direct ingestion. shadow marks a sample whose
+// owner changed mid-rebalance (see RebalancingRing); see drain for
+// how shadow samples are held back from being flushed alone.
+func (w *Worker) processForwarded(m samplers.UDPMetric, shadow bool) {
+	w.ingest(m, shadow)
+}
+
+func (w *Worker) ingest(m samplers.UDPMetric, shadow bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[m.MetricKey] = append(w.samples[m.MetricKey], workerSample{metric: m, shadow: shadow})
+}
+
+// drain atomically removes and returns every sample group that
+// contains at least one non-shadow sample. A group made up entirely
+// of shadow samples is left in place for up to shadowOnlyHoldbackDrains
+// further calls: it means a rebalance has routed this key to us, but
+// no primary (non-shadow) copy has arrived yet, likely because another
+// replica is still flushing its own pre-rebalance view of the same
+// key. Flushing it now would risk emitting the same count twice once
+// that replica also flushes; holding it lets the two converge into one
+// emission. If a primary still hasn't shown up once the holdback is
+// exhausted, the old owner is presumed gone rather than just slow, and
+// the shadow-only group is flushed on its own so the metric isn't
+// silently dropped forever.
+func (w *Worker) drain() map[samplers.MetricKey][]samplers.UDPMetric {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	out := map[samplers.MetricKey][]samplers.UDPMetric{}
+	remaining := map[samplers.MetricKey][]workerSample{}
+	for key, group := range w.samples {
+		hasPrimary := false
+		for _, s := range group {
+			if !s.shadow {
+				hasPrimary = true
+				break
+			}
+		}
+		if !hasPrimary && w.deferred[key] < shadowOnlyHoldbackDrains {
+			w.deferred[key]++
+			remaining[key] = group
+			continue
+		}
+		delete(w.deferred, key)
+
+		metrics := make([]samplers.UDPMetric, len(group))
+		for i, s := range group {
+			metrics[i] = s.metric
+		}
+		out[key] = metrics
+	}
+	w.samples = remaining
+	return out
+}
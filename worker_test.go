@@ -0,0 +1,78 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stripe/veneur/v14/samplers"
+)
+
+// TestWorkerDefersShadowOnlyGroupsUntilPrimaryArrives verifies the
+// mechanism that prevents a rebalance from producing a duplicate
+// .count emission: a MetricKey group made up entirely of
+// shadow-tagged forwarded samples (i.e. this Worker only has it
+// because RebalancingRing routed it here as shadow traffic during a
+// rebalance) is held back by drain rather than flushed, and is merged
+// with a primary sample for the same key that arrives within the
+// shadowOnlyHoldbackDrains holdback.
+func TestWorkerDefersShadowOnlyGroupsUntilPrimaryArrives(t *testing.T) {
+	w := NewWorker()
+	key := samplers.MetricKey{Name: "test.worker.shadow", Type: CounterTypeName}
+
+	w.processForwarded(samplers.UDPMetric{
+		MetricKey: key, Value: 1.0, SampleRate: 1.0, Scope: samplers.GlobalOnly,
+	}, true)
+
+	drained := w.drain()
+	assert.Empty(t, drained, "a shadow-only group must not be flushed on its own")
+
+	w.processForwarded(samplers.UDPMetric{
+		MetricKey: key, Value: 2.0, SampleRate: 1.0, Scope: samplers.GlobalOnly,
+	}, false)
+
+	drained = w.drain()
+	assert.Len(t, drained[key], 2,
+		"once a primary copy arrives, it's merged with the held-back shadow samples and flushed exactly once")
+
+	drained = w.drain()
+	assert.Empty(t, drained, "nothing is left behind to flush a second time")
+}
+
+// TestWorkerFlushesShadowOnlyGroupAfterOneDeferredDrain verifies that a
+// shadow-only group whose primary never arrives (e.g. the old owner is
+// gone for good, not just slow to flush) is not held back forever: it
+// is force-flushed on its own once shadowOnlyHoldbackDrains worth of
+// drain calls have passed without a primary showing up.
+func TestWorkerFlushesShadowOnlyGroupAfterOneDeferredDrain(t *testing.T) {
+	w := NewWorker()
+	key := samplers.MetricKey{Name: "test.worker.shadow.orphaned", Type: CounterTypeName}
+
+	w.processForwarded(samplers.UDPMetric{
+		MetricKey: key, Value: 1.0, SampleRate: 1.0, Scope: samplers.GlobalOnly,
+	}, true)
+
+	drained := w.drain()
+	assert.Empty(t, drained, "a shadow-only group must not be flushed on its first drain")
+
+	drained = w.drain()
+	assert.Len(t, drained[key], 1,
+		"once the holdback is exhausted with no primary, the shadow-only group is flushed on its own")
+
+	drained = w.drain()
+	assert.Empty(t, drained, "nothing is left behind to flush a second time")
+}
+
+// TestWorkerProcessMetricIsNeverDeferred verifies that samples
+// ingested directly (not via a forwarded batch) are never held back,
+// since they can never be shadow-only.
+func TestWorkerProcessMetricIsNeverDeferred(t *testing.T) {
+	w := NewWorker()
+	key := samplers.MetricKey{Name: "test.worker.direct", Type: CounterTypeName}
+	w.ProcessMetric(&samplers.UDPMetric{
+		MetricKey: key, Value: 3.0, SampleRate: 1.0, Scope: samplers.LocalOnly,
+	})
+
+	drained := w.drain()
+	assert.Len(t, drained[key], 1, "directly-ingested samples always flush on the next drain")
+}